@@ -0,0 +1,64 @@
+package publisher
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
+)
+
+// ParserPublisher adapts a Publisher to the old blob-based Write(string)
+// API that every backend used to implement itself. It owns the parser
+// pipeline for the wrapped Publisher and feeds it one event.Event at a
+// time, so callers still holding a raw text blob keep working unchanged
+// while they migrate to driving Publisher.OnEvent from a shared tail-loop
+// parser.
+type ParserPublisher struct {
+	Publisher Publisher
+	Parser    parsers.Parser
+	// Label identifies this adapter's wrapped publisher in metrics (see
+	// metrics.linesDepth). Defaults to the wrapped Publisher's type name.
+	Label string
+
+	initialized bool
+	lines       chan string
+	events      chan event.Event
+}
+
+// Write accepts a long blob of text, parses it, and hands each resulting
+// event to the wrapped Publisher.
+func (p *ParserPublisher) Write(chunk string) {
+	if !p.initialized {
+		fmt.Fprintln(os.Stderr, "initializing parser publisher adapter")
+		p.initialized = true
+		if p.Label == "" {
+			p.Label = fmt.Sprintf("%T", p.Publisher)
+		}
+		p.lines = make(chan string)
+		p.events = make(chan event.Event)
+		parseErrs := make(chan error)
+		go func() {
+			p.Parser.ProcessLines(p.lines, p.events, parseErrs)
+			close(p.events)
+		}()
+		go func() {
+			for range parseErrs {
+				metrics.parseErrors.WithLabelValues(p.Label).Inc()
+			}
+		}()
+		go func() {
+			for ev := range p.events {
+				p.Publisher.OnEvent(ev)
+			}
+		}()
+	}
+	for _, line := range strings.Split(chunk, "\n") {
+		if line == "" {
+			continue
+		}
+		p.lines <- line
+		metrics.linesDepth.WithLabelValues(p.Label).Set(float64(len(p.lines)))
+	}
+}
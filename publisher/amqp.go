@@ -0,0 +1,211 @@
+package publisher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/streadway/amqp"
+)
+
+// reconnectDelay is the initial backoff used while reconnecting to a broker
+// that has dropped the connection. It doubles on each failed attempt up to
+// maxReconnectDelay.
+const (
+	reconnectDelay    = 500 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+)
+
+// AMQPPublisher implements Publisher and publishes parsed events as JSON
+// messages to a RabbitMQ exchange.
+type AMQPPublisher struct {
+	URL        string
+	Exchange   string
+	RoutingKey string
+	Persistent bool
+	Confirm    bool
+	// ExchangeType is the AMQP exchange type to declare if a.Exchange
+	// doesn't already exist. Defaults to "topic", which works with
+	// RoutingKey templating.
+	ExchangeType string
+	// Filter restricts which events are published. A nil Filter publishes
+	// everything.
+	Filter       *FilterChain
+	initialized  bool
+	eventsToSend chan event.Event
+	routingTmpl  *template.Template
+}
+
+func (a *AMQPPublisher) init() {
+	fmt.Fprintln(os.Stderr, "initializing amqp publisher")
+	a.initialized = true
+
+	tmpl, err := template.New("routingKey").Parse(a.RoutingKey)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"routing_key": a.RoutingKey,
+			"error":       err,
+		}).Error("Unable to parse routing key template, falling back to literal key")
+		tmpl = nil
+	}
+	a.routingTmpl = tmpl
+
+	a.eventsToSend = make(chan event.Event)
+	go a.sendLoop()
+}
+
+// OnEvent implements Publisher.
+func (a *AMQPPublisher) OnEvent(ev event.Event) bool {
+	if !a.initialized {
+		a.init()
+	}
+	metrics.linesReceived.WithLabelValues("amqp").Inc()
+	a.eventsToSend <- ev
+	metrics.eventsDepth.WithLabelValues("amqp").Set(float64(len(a.eventsToSend)))
+	return true
+}
+
+// sendLoop owns the connection to the broker for the lifetime of the
+// publisher, reconnecting with backoff whenever the connection is lost.
+func (a *AMQPPublisher) sendLoop() {
+	fmt.Fprintln(os.Stderr, "spinning up goroutine to send events to amqp")
+	var ch *amqp.Channel
+	var conn *amqp.Connection
+	var confirms chan amqp.Confirmation
+
+	connect := func() error {
+		var err error
+		conn, err = amqp.Dial(a.URL)
+		if err != nil {
+			return err
+		}
+		ch, err = conn.Channel()
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		exchangeType := a.ExchangeType
+		if exchangeType == "" {
+			exchangeType = "topic"
+		}
+		if err := ch.ExchangeDeclare(a.Exchange, exchangeType, true, false, false, false, nil); err != nil {
+			ch.Close()
+			conn.Close()
+			return fmt.Errorf("unable to declare exchange %q: %v", a.Exchange, err)
+		}
+		if a.Confirm {
+			if err := ch.Confirm(false); err != nil {
+				ch.Close()
+				conn.Close()
+				return err
+			}
+			confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+		}
+		return nil
+	}
+
+	backoff := reconnectDelay
+	for {
+		if err := connect(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"url":   a.URL,
+				"error": err,
+			}).Error("Unable to connect to amqp broker, retrying")
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxReconnectDelay {
+				backoff = maxReconnectDelay
+			}
+			continue
+		}
+		break
+	}
+	backoff = reconnectDelay
+
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	for ev := range a.Filter.Wrap(a.eventsToSend) {
+		metrics.linesParsed.WithLabelValues("amqp").Inc()
+		body, err := json.Marshal(ev.Data)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"event": ev,
+				"error": err,
+			}).Error("Unexpected error marshaling event to JSON")
+			continue
+		}
+
+		deliveryMode := uint8(amqp.Transient)
+		if a.Persistent {
+			deliveryMode = amqp.Persistent
+		}
+
+		msg := amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: deliveryMode,
+			Timestamp:    ev.Timestamp,
+			Body:         body,
+		}
+
+	publish:
+		start := time.Now()
+		err = ch.Publish(a.Exchange, a.routingKeyFor(ev), false, false, msg)
+		if err == nil && a.Confirm {
+			confirmed := <-confirms
+			if !confirmed.Ack {
+				err = fmt.Errorf("broker did not ack delivery")
+			}
+		}
+		metrics.sendLatency.WithLabelValues("amqp").Observe(time.Since(start).Seconds())
+		if err != nil {
+			metrics.sendErrors.WithLabelValues("amqp").Inc()
+			logrus.WithFields(logrus.Fields{
+				"exchange": a.Exchange,
+				"error":    err,
+			}).Error("Unexpected error publishing event to amqp, reconnecting")
+
+			for {
+				if cerr := connect(); cerr != nil {
+					time.Sleep(backoff)
+					if backoff *= 2; backoff > maxReconnectDelay {
+						backoff = maxReconnectDelay
+					}
+					continue
+				}
+				break
+			}
+			backoff = reconnectDelay
+			closed = conn.NotifyClose(make(chan *amqp.Error, 1))
+			goto publish
+		}
+		metrics.eventsSent.WithLabelValues("amqp").Inc()
+
+		select {
+		case <-closed:
+			closed = conn.NotifyClose(make(chan *amqp.Error, 1))
+		default:
+		}
+	}
+}
+
+// routingKeyFor renders the configured routing key template against the
+// event's fields, falling back to the literal routing key if no template
+// was configured or it failed to parse.
+func (a *AMQPPublisher) routingKeyFor(ev event.Event) string {
+	if a.routingTmpl == nil {
+		return a.RoutingKey
+	}
+	var buf bytes.Buffer
+	if err := a.routingTmpl.Execute(&buf, ev.Data); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"event": ev,
+			"error": err,
+		}).Error("Unexpected error rendering routing key template, using literal key")
+		return a.RoutingKey
+	}
+	return buf.String()
+}
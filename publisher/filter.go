@@ -0,0 +1,94 @@
+package publisher
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// Filter reports whether an event should be allowed through a FilterChain.
+type Filter func(ev event.Event) bool
+
+// FilterChain restricts a stream of parsed events to those occurring
+// within [Since, Until] and matching every configured Filter. It sits
+// between Parser.ProcessLines and a publisher's send goroutine so the
+// same --since/--until/--filter flags work the same way across every
+// backend.
+type FilterChain struct {
+	Since   time.Time
+	Until   time.Time
+	Filters []Filter
+}
+
+// Allow reports whether ev passes every predicate in the chain. A nil
+// *FilterChain allows everything, so publishers can wire it in
+// unconditionally.
+func (f *FilterChain) Allow(ev event.Event) bool {
+	if f == nil {
+		return true
+	}
+	if !f.Since.IsZero() && ev.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && ev.Timestamp.After(f.Until) {
+		return false
+	}
+	for _, filter := range f.Filters {
+		if !filter(ev) {
+			return false
+		}
+	}
+	return true
+}
+
+// Wrap returns a channel that relays only the events from in that pass
+// the chain, closing the returned channel once in is drained. A nil
+// *FilterChain relays everything.
+func (f *FilterChain) Wrap(in <-chan event.Event) <-chan event.Event {
+	out := make(chan event.Event)
+	go func() {
+		defer close(out)
+		for ev := range in {
+			if f.Allow(ev) {
+				out <- ev
+			}
+		}
+	}()
+	return out
+}
+
+// ParseFilterExpr parses a single `--filter key=value` or
+// `--filter key=~regex` expression into a Filter that matches against
+// ev.Data[key].
+func ParseFilterExpr(expr string) (Filter, error) {
+	parts := strings.SplitN(expr, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, fmt.Errorf("invalid filter expression %q, expected key=value or key=~regex", expr)
+	}
+	key, val := parts[0], parts[1]
+
+	if strings.HasPrefix(val, "~") {
+		re, err := regexp.Compile(val[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter regex %q: %v", val[1:], err)
+		}
+		return func(ev event.Event) bool {
+			v, ok := ev.Data[key]
+			if !ok {
+				return false
+			}
+			return re.MatchString(fmt.Sprintf("%v", v))
+		}, nil
+	}
+
+	return func(ev event.Event) bool {
+		v, ok := ev.Data[key]
+		if !ok {
+			return false
+		}
+		return fmt.Sprintf("%v", v) == val
+	}, nil
+}
@@ -0,0 +1,103 @@
+package publisher
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// pipelineMetrics holds the instrumentation shared by every Publisher
+// implementation's tail goroutines. A single instance is registered once
+// with the default prometheus registry and shared by every publisher; no
+// publisher registers a collector of its own. Operators tell backends
+// apart by the "publisher" label.
+type pipelineMetrics struct {
+	linesReceived  *prometheus.CounterVec
+	linesParsed    *prometheus.CounterVec
+	eventsSent     *prometheus.CounterVec
+	parseErrors    *prometheus.CounterVec
+	sendErrors     *prometheus.CounterVec
+	sendLatency    *prometheus.HistogramVec
+	linesDepth     *prometheus.GaugeVec
+	eventsDepth    *prometheus.GaugeVec
+	spoolEvictions *prometheus.CounterVec
+}
+
+var metrics = newPipelineMetrics()
+
+func newPipelineMetrics() *pipelineMetrics {
+	labels := []string{"publisher"}
+	m := &pipelineMetrics{
+		linesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "rdslogs",
+			Name:      "lines_received_total",
+			Help:      "Number of parsed events handed to a publisher.",
+		}, labels),
+		linesParsed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "rdslogs",
+			Name:      "lines_parsed_total",
+			Help:      "Number of log lines successfully parsed into events.",
+		}, labels),
+		eventsSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "rdslogs",
+			Name:      "events_sent_total",
+			Help:      "Number of events successfully sent downstream.",
+		}, labels),
+		parseErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "rdslogs",
+			Name:      "parse_errors_total",
+			Help:      "Number of log lines that failed to parse.",
+		}, labels),
+		sendErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "rdslogs",
+			Name:      "send_errors_total",
+			Help:      "Number of events that failed to send downstream.",
+		}, labels),
+		sendLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "rdslogs",
+			Name:      "send_latency_seconds",
+			Help:      "Time taken to send a single event downstream.",
+			Buckets:   prometheus.DefBuckets,
+		}, labels),
+		linesDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "rdslogs",
+			Name:      "lines_channel_depth",
+			Help:      "Current number of buffered entries in a publisher's lines channel.",
+		}, labels),
+		eventsDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "rdslogs",
+			Name:      "events_to_send_channel_depth",
+			Help:      "Current number of buffered entries in a publisher's eventsToSend channel.",
+		}, labels),
+		spoolEvictions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "rdslogs",
+			Name:      "spool_evictions_total",
+			Help:      "Number of spooled files evicted because a disk spool exceeded its configured limits.",
+		}, labels),
+	}
+	prometheus.MustRegister(
+		m.linesReceived,
+		m.linesParsed,
+		m.eventsSent,
+		m.parseErrors,
+		m.sendErrors,
+		m.sendLatency,
+		m.linesDepth,
+		m.eventsDepth,
+		m.spoolEvictions,
+	)
+	return m
+}
+
+// ServeMetrics starts an HTTP server exposing the pipeline's prometheus
+// metrics on /metrics. It is opt-in: callers only start it when the
+// operator has asked for metrics on the command line.
+func ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	fmt.Fprintf(logrus.StandardLogger().Out, "serving prometheus metrics on %s/metrics\n", addr)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,111 @@
+package publisher
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/event"
+)
+
+// MultiPublisher implements Publisher and fans a single event out to
+// several child publishers concurrently, so operators can send to e.g.
+// Honeycomb and a local JSON archive at the same time off the one shared
+// parser pipeline. Each child runs in isolation: a panic in one does not
+// stop the others from receiving the event.
+type MultiPublisher struct {
+	Publishers []Publisher
+	// SampleRates, if set, is parallel to Publishers: a value of N sends
+	// roughly 1 in N events to that child. A zero or missing entry sends
+	// every event to that child.
+	SampleRates []int
+
+	counters []uint64
+}
+
+// OnEvent implements Publisher. It returns false only once every child
+// that was actually dispatched to returned false, so the tail loop keeps
+// feeding MultiPublisher as long as at least one child can still accept
+// events. A round where every child is skipped by sampling is not a
+// signal that any child died, so it counts as alive too.
+func (m *MultiPublisher) OnEvent(ev event.Event) bool {
+	if len(m.counters) != len(m.Publishers) {
+		m.counters = make([]uint64, len(m.Publishers))
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	dispatched := false
+	live := false
+	for i, pub := range m.Publishers {
+		rate := 0
+		if i < len(m.SampleRates) {
+			rate = m.SampleRates[i]
+		}
+		if rate > 1 {
+			n := atomic.AddUint64(&m.counters[i], 1)
+			if n%uint64(rate) != 0 {
+				continue
+			}
+		}
+
+		// Each child gets its own copy of ev.Data so concurrent children
+		// can freely read and mutate their copy (e.g. JSONStdout adding
+		// a "timestamp" field, HoneycombPublisher scrubbing "query")
+		// without racing each other.
+		evCopy := copyEvent(ev)
+
+		wg.Add(1)
+		dispatched = true
+		go func(pub Publisher) {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					logrus.WithFields(logrus.Fields{
+						"publisher": fmt.Sprintf("%T", pub),
+						"panic":     r,
+					}).Error("Recovered from panic in child publisher")
+				}
+			}()
+			if pub.OnEvent(evCopy) {
+				mu.Lock()
+				live = true
+				mu.Unlock()
+			}
+		}(pub)
+	}
+	wg.Wait()
+
+	if !dispatched {
+		return true
+	}
+	return live
+}
+
+// copyEvent returns ev with a shallow copy of its Data map, so a child
+// publisher can be handed its own map to read and mutate independently
+// of its siblings.
+func copyEvent(ev event.Event) event.Event {
+	data := make(map[string]interface{}, len(ev.Data))
+	for k, v := range ev.Data {
+		data[k] = v
+	}
+	ev.Data = data
+	return ev
+}
+
+// closer is implemented by publishers that need to flush outstanding
+// sends on shutdown, such as HoneycombPublisher.
+type closer interface {
+	Close()
+}
+
+// Close calls Close on every child publisher that implements it.
+func (m *MultiPublisher) Close() {
+	for _, pub := range m.Publishers {
+		if c, ok := pub.(closer); ok {
+			c.Close()
+		}
+	}
+}
@@ -4,101 +4,219 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"io"
 	"os"
-	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/honeycombio/honeytail/event"
-	"github.com/honeycombio/honeytail/parsers"
 	libhoney "github.com/honeycombio/libhoney-go"
 )
 
-// Publisher is an interface to write rdslogs entries to a target. Current
-// implementations are STDOUT and Honeycomb
+// Publisher is implemented by every rdslogs output backend. The tail loop
+// owns a single parser pipeline and calls OnEvent once per parsed event,
+// rather than each backend re-parsing the raw log text itself. OnEvent
+// returns false to tell the tail loop the publisher can no longer accept
+// events (for example, after it has been closed), so the loop can stop
+// feeding it and close the shared event channel instead of racing
+// shutdown against in-flight send goroutines.
 type Publisher interface {
-	// Write accepts a long blob of text and writes it to the target
-	Write(blob string)
+	OnEvent(ev event.Event) bool
 }
 
-// HoneycombPublisher implements Publisher and sends the entries provided to
+// HoneycombPublisher implements Publisher and sends the events provided to
 // Honeycomb
 type HoneycombPublisher struct {
-	Writekey     string
-	Dataset      string
-	APIHost      string
-	ScrubQuery   bool
-	SampleRate   int
-	Parser       parsers.Parser
-	AddFields    map[string]string
+	Writekey   string
+	Dataset    string
+	APIHost    string
+	ScrubQuery bool
+	SampleRate int
+	AddFields  map[string]string
+	// Filter restricts which events are sent to Honeycomb. A nil Filter
+	// sends everything.
+	Filter *FilterChain
+
+	// SpoolDir, if set, enables a disk-backed spool that absorbs events
+	// when the send pipeline can't keep up, instead of blocking OnEvent
+	// on a full eventsToSend channel.
+	SpoolDir      string
+	MaxDiskFiles  int
+	MaxDiskSizeMB int
+	// SendQueue is the size of the buffered channel feeding the send
+	// goroutine. A larger queue absorbs brief stalls before spilling to
+	// disk. It defaults to 0 (unbuffered), in which case the
+	// eventsDepth metric always reads 0.
+	SendQueue int
+
 	initialized  bool
-	lines        chan string
 	eventsToSend chan event.Event
+	spool        *diskSpool
 }
 
-func (h *HoneycombPublisher) Write(chunk string) {
-	if !h.initialized {
-		fmt.Fprintln(os.Stderr, "initializing honeycomb")
-		h.initialized = true
-		libhoney.Init(libhoney.Config{
-			WriteKey:   h.Writekey,
-			Dataset:    h.Dataset,
-			APIHost:    h.APIHost,
-			SampleRate: uint(h.SampleRate),
-		})
-		h.lines = make(chan string)
-		h.eventsToSend = make(chan event.Event)
-		go func() {
-			h.Parser.ProcessLines(h.lines, h.eventsToSend, nil)
-			close(h.eventsToSend)
-		}()
-		go func() {
-			fmt.Fprintln(os.Stderr, "spinning up goroutine to send events")
-			for ev := range h.eventsToSend {
-				if h.ScrubQuery {
-					if val, ok := ev.Data["query"]; ok {
-						// generate a sha256 hash
-						newVal := sha256.Sum256([]byte(fmt.Sprintf("%v", val)))
-						// and use the base16 string version of it
-						ev.Data["query"] = fmt.Sprintf("%x", newVal)
-					}
-				}
-				libhEv := libhoney.NewEvent()
-				libhEv.Timestamp = ev.Timestamp
-
-				// add extra fields first so they don't override anything parsed
-				// in the log file
-				if err := libhEv.Add(h.AddFields); err != nil {
-					logrus.WithFields(logrus.Fields{
-						"add_fields": h.AddFields,
-						"error":      err,
-					}).Error("Unexpected error adding extra fields data to libhoney event")
-				}
-
-				if err := libhEv.Add(ev.Data); err != nil {
-					logrus.WithFields(logrus.Fields{
-						"event": ev,
-						"error": err,
-					}).Error("Unexpected error adding data to libhoney event")
-				}
-				// sampling is handled by the mysql parser
-				// TODO make this work for postgres too
-				if err := libhEv.SendPresampled(); err != nil {
-					logrus.WithFields(logrus.Fields{
-						"event": ev,
-						"error": err,
-					}).Error("Unexpected error event to libhoney send")
-				}
+func (h *HoneycombPublisher) init() {
+	fmt.Fprintln(os.Stderr, "initializing honeycomb")
+	h.initialized = true
+	libhoney.Init(libhoney.Config{
+		WriteKey:   h.Writekey,
+		Dataset:    h.Dataset,
+		APIHost:    h.APIHost,
+		SampleRate: uint(h.SampleRate),
+	})
+	h.eventsToSend = make(chan event.Event, h.SendQueue)
 
-			}
-		}()
+	if h.SpoolDir != "" {
+		spool, err := newDiskSpool(h.SpoolDir, h.MaxDiskFiles, h.MaxDiskSizeMB, "honeycomb")
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"spool_dir": h.SpoolDir,
+				"error":     err,
+			}).Error("Unable to initialize disk spool, falling back to blocking sends")
+		} else {
+			h.spool = spool
+			// drain anything spooled during a previous outage; this
+			// runs alongside new events rather than ahead of them
+			go h.drainSpool()
+		}
 	}
-	lines := strings.Split(chunk, "\n")
-	for _, line := range lines {
-		if line == "" {
+
+	go h.sendLoop()
+}
+
+// spooledEvent is the on-disk representation of a spooled event. It keeps
+// Timestamp alongside Data so a drained event is indistinguishable from
+// one that never left memory.
+type spooledEvent struct {
+	Timestamp time.Time
+	Data      map[string]interface{}
+}
+
+// spoolDrainInterval is how often drainSpool re-checks the spool
+// directory for events written by sendOrSpool since the last pass.
+const spoolDrainInterval = 5 * time.Second
+
+// drainSpool moves events from disk back into eventsToSend for as long as
+// the publisher is running, not just once at startup. Without this, any
+// event spooled during an in-process outage would sit on disk until the
+// next restart and could be evicted by enforceLimits before ever being
+// sent, defeating the spool's durability guarantee.
+func (h *HoneycombPublisher) drainSpool() {
+	raw := make(chan string)
+	go func() {
+		for {
+			h.spool.Drain(raw)
+			time.Sleep(spoolDrainInterval)
+		}
+	}()
+	for data := range raw {
+		var spooled spooledEvent
+		if err := json.Unmarshal([]byte(data), &spooled); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Unable to decode spooled event, dropping it")
 			continue
 		}
-		h.lines <- line
+		h.eventsToSend <- event.Event{Timestamp: spooled.Timestamp, Data: spooled.Data}
+		metrics.eventsDepth.WithLabelValues("honeycomb").Set(float64(len(h.eventsToSend)))
+	}
+}
+
+func (h *HoneycombPublisher) sendLoop() {
+	fmt.Fprintln(os.Stderr, "spinning up goroutine to send events")
+	for ev := range h.Filter.Wrap(h.eventsToSend) {
+		metrics.linesParsed.WithLabelValues("honeycomb").Inc()
+		if h.ScrubQuery {
+			if val, ok := ev.Data["query"]; ok {
+				// generate a sha256 hash
+				newVal := sha256.Sum256([]byte(fmt.Sprintf("%v", val)))
+				// and use the base16 string version of it
+				ev.Data["query"] = fmt.Sprintf("%x", newVal)
+			}
+		}
+		libhEv := libhoney.NewEvent()
+		libhEv.Timestamp = ev.Timestamp
+
+		// add extra fields first so they don't override anything parsed
+		// in the log file
+		if err := libhEv.Add(h.AddFields); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"add_fields": h.AddFields,
+				"error":      err,
+			}).Error("Unexpected error adding extra fields data to libhoney event")
+		}
+
+		if err := libhEv.Add(ev.Data); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"event": ev,
+				"error": err,
+			}).Error("Unexpected error adding data to libhoney event")
+		}
+		// sampling is handled by the mysql parser
+		// TODO make this work for postgres too
+		start := time.Now()
+		err := libhEv.SendPresampled()
+		metrics.sendLatency.WithLabelValues("honeycomb").Observe(time.Since(start).Seconds())
+		if err != nil {
+			metrics.sendErrors.WithLabelValues("honeycomb").Inc()
+			logrus.WithFields(logrus.Fields{
+				"event": ev,
+				"error": err,
+			}).Error("Unexpected error event to libhoney send")
+		} else {
+			metrics.eventsSent.WithLabelValues("honeycomb").Inc()
+		}
+	}
+}
+
+// OnEvent implements Publisher.
+func (h *HoneycombPublisher) OnEvent(ev event.Event) bool {
+	if !h.initialized {
+		h.init()
+	}
+	metrics.linesReceived.WithLabelValues("honeycomb").Inc()
+	h.sendOrSpool(ev)
+	return true
+}
+
+// sendOrSpool feeds an event to the send goroutine, spooling it to disk
+// instead of blocking when eventsToSend is full and a spool is
+// configured. Without a spool it falls back to the old blocking behavior.
+//
+// eventsDepth is measured here, right after the event lands in
+// eventsToSend, rather than in sendLoop: sendLoop reads through
+// h.Filter.Wrap, a second unbuffered relay channel, so measuring there
+// reflects that channel's depth (always 0) rather than the actual
+// backlog sitting in eventsToSend.
+func (h *HoneycombPublisher) sendOrSpool(ev event.Event) {
+	select {
+	case h.eventsToSend <- ev:
+		metrics.eventsDepth.WithLabelValues("honeycomb").Set(float64(len(h.eventsToSend)))
+		return
+	default:
+	}
+
+	if h.spool == nil {
+		h.eventsToSend <- ev
+		metrics.eventsDepth.WithLabelValues("honeycomb").Set(float64(len(h.eventsToSend)))
+		return
+	}
+
+	data, err := json.Marshal(spooledEvent{Timestamp: ev.Timestamp, Data: ev.Data})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"event": ev,
+			"error": err,
+		}).Error("Unable to marshal event for spooling, blocking until send pipeline recovers")
+		h.eventsToSend <- ev
+		metrics.eventsDepth.WithLabelValues("honeycomb").Set(float64(len(h.eventsToSend)))
+		return
+	}
+	if err := h.spool.Push(string(data)); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"spool_dir": h.SpoolDir,
+			"error":     err,
+		}).Error("Unable to spool event to disk, blocking until send pipeline recovers")
+		h.eventsToSend <- ev
+		metrics.eventsDepth.WithLabelValues("honeycomb").Set(float64(len(h.eventsToSend)))
 	}
 }
 
@@ -107,50 +225,68 @@ func (h *HoneycombPublisher) Close() {
 	libhoney.Close()
 }
 
-// STDOUTPublisher implements Publisher and prints to stdout.
+// STDOUTPublisher implements Publisher and prints events to stdout as
+// JSON, one object per line. Since the tail loop only ever hands
+// publishers parsed events now, this is the defined replacement for the
+// old behavior of writing the raw log line verbatim.
 type STDOUTPublisher struct {
+	// Filter restricts which events are printed. A nil Filter prints
+	// everything.
+	Filter *FilterChain
 }
 
-func (s *STDOUTPublisher) Write(line string) {
-	io.WriteString(os.Stdout, line)
+// OnEvent implements Publisher.
+func (s *STDOUTPublisher) OnEvent(ev event.Event) bool {
+	metrics.linesReceived.WithLabelValues("stdout").Inc()
+	if !s.Filter.Allow(ev) {
+		return true
+	}
+	metrics.linesParsed.WithLabelValues("stdout").Inc()
+	data := make(map[string]interface{}, len(ev.Data)+1)
+	for k, v := range ev.Data {
+		data[k] = v
+	}
+	data["timestamp"] = ev.Timestamp
+	start := time.Now()
+	err := json.NewEncoder(os.Stdout).Encode(data)
+	metrics.sendLatency.WithLabelValues("stdout").Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.sendErrors.WithLabelValues("stdout").Inc()
+		logrus.WithFields(logrus.Fields{
+			"event": ev,
+			"error": err,
+		}).Error("Unexpected error printing event to stdout")
+		return true
+	}
+	metrics.eventsSent.WithLabelValues("stdout").Inc()
+	return true
 }
 
 // JSONStdout implements Publisher and prints JSON events to stdout.
 type JSONStdout struct {
-	initialized  bool
-	Parser       parsers.Parser
-	lines        chan string
-	eventsToSend chan event.Event
+	// Filter restricts which events are printed. A nil Filter prints
+	// everything.
+	Filter *FilterChain
 }
 
-func (s *JSONStdout) Write(chunk string) {
-	if !s.initialized {
-		fmt.Fprintln(os.Stderr, "initializing JSONStdout")
-		s.initialized = true
-		s.lines = make(chan string)
-		s.eventsToSend = make(chan event.Event)
-		go func() {
-			s.Parser.ProcessLines(s.lines, s.eventsToSend, nil)
-			close(s.eventsToSend)
-		}()
-		go func() {
-			fmt.Fprintln(os.Stderr, "spinning up goroutine to send events")
-			for ev := range s.eventsToSend {
-				ev.Data["timestamp"] = ev.Timestamp
-				if err := json.NewEncoder(os.Stdout).Encode(ev.Data); err != nil {
-					logrus.WithFields(logrus.Fields{
-						"event": ev,
-						"error": err,
-					}).Error("Unexpected error printing event to stdout")
-				}
-			}
-		}()
+// OnEvent implements Publisher.
+func (s *JSONStdout) OnEvent(ev event.Event) bool {
+	if !s.Filter.Allow(ev) {
+		return true
 	}
-	lines := strings.Split(chunk, "\n")
-	for _, line := range lines {
-		if line == "" {
-			continue
-		}
-		s.lines <- line
+	metrics.linesParsed.WithLabelValues("stdout-json").Inc()
+	ev.Data["timestamp"] = ev.Timestamp
+	start := time.Now()
+	err := json.NewEncoder(os.Stdout).Encode(ev.Data)
+	metrics.sendLatency.WithLabelValues("stdout-json").Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.sendErrors.WithLabelValues("stdout-json").Inc()
+		logrus.WithFields(logrus.Fields{
+			"event": ev,
+			"error": err,
+		}).Error("Unexpected error printing event to stdout")
+		return true
 	}
+	metrics.eventsSent.WithLabelValues("stdout-json").Inc()
+	return true
 }
@@ -0,0 +1,170 @@
+package publisher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// diskSpool is a bounded, FIFO, on-disk queue of opaque string payloads
+// (HoneycombPublisher stores JSON-encoded spooledEvent records). It gives
+// HoneycombPublisher somewhere to put events when the downstream libhoney
+// send pipeline is stalled (API outage, rate limiting) instead of blocking
+// the tail goroutine on an unbuffered channel.
+type diskSpool struct {
+	dir          string
+	maxFiles     int
+	maxSizeMB    int
+	evictedLabel string
+	mu           sync.Mutex
+	seq          uint64
+}
+
+func newDiskSpool(dir string, maxFiles, maxSizeMB int, evictedLabel string) (*diskSpool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create spool dir %q: %v", dir, err)
+	}
+	d := &diskSpool{
+		dir:          dir,
+		maxFiles:     maxFiles,
+		maxSizeMB:    maxSizeMB,
+		evictedLabel: evictedLabel,
+	}
+
+	// Seed seq past any files already on disk from a previous run so Push
+	// never reuses a name and clobbers an undrained spool file.
+	names, err := d.spoolFiles()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list spool dir %q: %v", dir, err)
+	}
+	for _, name := range names {
+		n, err := strconv.ParseUint(strings.TrimSuffix(name, ".spool"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if n > d.seq {
+			d.seq = n
+		}
+	}
+
+	return d, nil
+}
+
+// spoolFiles returns the files currently on disk, oldest first.
+func (d *diskSpool) spoolFiles() ([]string, error) {
+	entries, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, fi := range entries {
+		if fi.IsDir() {
+			continue
+		}
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Push writes a line to a new spool file, evicting the oldest spooled
+// files if the configured limits are exceeded.
+func (d *diskSpool) Push(line string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.seq++
+	name := fmt.Sprintf("%020d.spool", d.seq)
+	path := filepath.Join(d.dir, name)
+	if err := ioutil.WriteFile(path, []byte(line), 0644); err != nil {
+		return fmt.Errorf("unable to write spool file %q: %v", path, err)
+	}
+
+	d.enforceLimits()
+	return nil
+}
+
+// enforceLimits evicts the oldest spool files until the configured file
+// count and on-disk size limits are satisfied. Callers must hold d.mu.
+func (d *diskSpool) enforceLimits() {
+	names, err := d.spoolFiles()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"dir":   d.dir,
+			"error": err,
+		}).Error("Unable to list spool dir while enforcing limits")
+		return
+	}
+
+	for d.maxFiles > 0 && len(names) > d.maxFiles {
+		d.evictOldest(&names)
+	}
+
+	for d.maxSizeMB > 0 && d.totalSizeMB(names) > float64(d.maxSizeMB) && len(names) > 0 {
+		d.evictOldest(&names)
+	}
+}
+
+func (d *diskSpool) totalSizeMB(names []string) float64 {
+	var total int64
+	for _, name := range names {
+		if fi, err := os.Stat(filepath.Join(d.dir, name)); err == nil {
+			total += fi.Size()
+		}
+	}
+	return float64(total) / (1024 * 1024)
+}
+
+func (d *diskSpool) evictOldest(names *[]string) {
+	if len(*names) == 0 {
+		return
+	}
+	oldest := (*names)[0]
+	*names = (*names)[1:]
+	if err := os.Remove(filepath.Join(d.dir, oldest)); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"file":  oldest,
+			"error": err,
+		}).Error("Unable to evict oldest spool file")
+		return
+	}
+	metrics.spoolEvictions.WithLabelValues(d.evictedLabel).Inc()
+}
+
+// Drain reads back every spooled payload, in the order it was written,
+// removing each file as it is consumed. Callers may invoke it repeatedly
+// (e.g. on a timer) to pick up payloads spooled since the last call, not
+// just once at startup.
+func (d *diskSpool) Drain(out chan<- string) {
+	d.mu.Lock()
+	names, err := d.spoolFiles()
+	d.mu.Unlock()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"dir":   d.dir,
+			"error": err,
+		}).Error("Unable to list spool dir while draining")
+		return
+	}
+
+	for _, name := range names {
+		path := filepath.Join(d.dir, name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"file":  path,
+				"error": err,
+			}).Error("Unable to read spool file while draining")
+			continue
+		}
+		out <- string(data)
+		os.Remove(path)
+	}
+}